@@ -1,9 +1,18 @@
 package consul
 
 import (
+	"errors"
+	"time"
+
 	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/raft"
 )
 
+// ErrNotLeader is returned by the SQL endpoint when a request that must be
+// served by the leader arrives on a server that either isn't the leader, or
+// doesn't yet know who the leader is.
+var ErrNotLeader = errors.New("node is not the leader")
+
 // SQL endpoint is used to manipulate the sql db store
 type SQL struct {
 	srv *Server
@@ -29,7 +38,10 @@ func (s *SQL) Query(args *structs.SQLQueryRequest, reply *structs.SQLQueryRespon
 // Execute executes queries that return no rows, but do modify the database. If connection
 // is nil then the utility connection is used.
 func (s *SQL) execute(args *structs.SQLExecuteRequest, reply *structs.SQLExecuteResponse) error {
-	// TODO: forward
+	if s.srv.raft.State() != raft.Leader {
+		return s.forwardLeader("SQL.Execute", args, reply)
+	}
+
 	f, err := s.srv.raftApply(structs.SQLExecuteRequestType, args)
 	if err != nil {
 		return err
@@ -38,7 +50,6 @@ func (s *SQL) execute(args *structs.SQLExecuteRequest, reply *structs.SQLExecute
 	switch r := f.(type) {
 	case *structs.SQLExecuteResponse:
 		*reply = *r
-		// TODO
 		return r.Err
 	case error:
 		return r
@@ -49,22 +60,84 @@ func (s *SQL) execute(args *structs.SQLExecuteRequest, reply *structs.SQLExecute
 }
 
 // Query executes queries that return rows, and do not modify the database. If
-// connection is nil, then the utility connection is used.
+// connection is nil, then the utility connection is used. Depending on
+// args.Lvl, this is served locally (None, Weak) or linearized through Raft
+// (Strong).
 func (s *SQL) query(args *structs.SQLQueryRequest, reply *structs.SQLQueryResponse) error {
-	// TODO: forward
-	f, err := s.srv.raftApply(structs.SQLQueryRequestType, args)
-	if err != nil {
-		return err
+	switch args.Lvl {
+	case structs.None:
+		return s.queryLocal(args, reply)
+
+	case structs.Weak:
+		if s.srv.raft.State() != raft.Leader {
+			return s.forwardLeader("SQL.Query", args, reply)
+		}
+		return s.queryLocal(args, reply)
+
+	default: // structs.Strong
+		if s.srv.raft.State() != raft.Leader {
+			return s.forwardLeader("SQL.Query", args, reply)
+		}
+
+		f, err := s.srv.raftApply(structs.SQLQueryRequestType, args)
+		if err != nil {
+			return err
+		}
+
+		switch r := f.(type) {
+		case *structs.SQLQueryResponse:
+			*reply = *r
+			return r.Err
+		case error:
+			return r
+		default:
+			panic("unsupported type")
+		}
+		return nil
 	}
+}
 
-	switch r := f.(type) {
+// queryLocal serves a query directly from this node's database, bypassing
+// raftApply. Used for the None and Weak consistency levels.
+func (s *SQL) queryLocal(args *structs.SQLQueryRequest, reply *structs.SQLQueryResponse) error {
+	maxStale := time.Duration(0)
+	if args.Lvl == structs.None {
+		maxStale = args.FreshnessMaxStale
+	}
+
+	r := s.srv.fsm.State().Query(args.GetStatements(), args.Atomic, maxStale)
+	switch v := r.(type) {
 	case *structs.SQLQueryResponse:
-		*reply = *r
-		return r.Err
+		*reply = *v
+		return v.Err
 	case error:
-		return r
+		return v
 	default:
 		panic("unsupported type")
 	}
-	return nil
+}
+
+// forwardLeader forwards args to whichever server is the current Raft
+// leader, using the server's RPC connection pool. It returns ErrNotLeader
+// if the leader is not yet known.
+func (s *SQL) forwardLeader(method string, args interface{}, reply interface{}) error {
+	leader := s.srv.raft.Leader()
+	if leader == "" {
+		return ErrNotLeader
+	}
+
+	server := s.srv.serverLookup.Server(leader)
+	if server == nil {
+		return ErrNotLeader
+	}
+
+	return s.srv.connPool.RPC(s.srv.config.Datacenter, server.Addr, server.Version,
+		method, server.UseTLS, args, reply)
+}
+
+// Stepdown forces this server to give up Raft leadership, if it is the
+// leader. It exists so tests can exercise the SQL endpoint's
+// forward-to-leader path without standing up a full cluster shutdown.
+func (s *Server) Stepdown() error {
+	return s.raft.LeadershipTransfer().Error()
 }
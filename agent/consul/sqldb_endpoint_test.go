@@ -0,0 +1,153 @@
+package consul
+
+import (
+	"os"
+	"testing"
+
+	"github.com/hashicorp/consul/agent/consul/state/sqlite"
+	"github.com/hashicorp/consul/agent/structs"
+	"github.com/hashicorp/consul/testrpc"
+	"github.com/hashicorp/net-rpc-msgpackrpc"
+)
+
+// TestSQL_Execute_ForwardToLeader exercises the non-leader path of
+// SQL.Execute: a request submitted against a follower must be forwarded to
+// the leader via forwardLeader, rather than failing with ErrNotLeader.
+func TestSQL_Execute_ForwardToLeader(t *testing.T) {
+	t.Parallel()
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDC(t, s1.config.Datacenter)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	joinLAN(t, s2, s1)
+	testrpc.WaitForLeader(t, s1.RPC, s1.config.Datacenter)
+
+	// Find the follower: the one that didn't become leader.
+	follower := s1
+	if s1.IsLeader() {
+		follower = s2
+	}
+
+	codec := rpcClient(t, follower)
+	defer codec.Close()
+
+	args := &structs.SQLExecuteRequest{
+		Statements: []*sqlite.Statement{{SQL: "CREATE TABLE foo (id INTEGER)"}},
+	}
+	var reply structs.SQLExecuteResponse
+	if err := msgpackrpc.CallWithCodec(codec, "SQL.Execute", args, &reply); err != nil {
+		t.Fatalf("execute against follower should have been forwarded, got: %v", err)
+	}
+	if reply.Err != nil {
+		t.Fatalf("err: %v", reply.Err)
+	}
+}
+
+// TestSQL_Stepdown confirms Stepdown actually relinquishes leadership, so
+// it can be relied on to exercise the forwarding path above in a 2-node
+// cluster without waiting on an election timeout.
+func TestSQL_Stepdown(t *testing.T) {
+	t.Parallel()
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDC(t, s1.config.Datacenter)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	joinLAN(t, s2, s1)
+	testrpc.WaitForLeader(t, s1.RPC, s1.config.Datacenter)
+
+	leader := s1
+	if s2.IsLeader() {
+		leader = s2
+	}
+	if err := leader.Stepdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testrpc.WaitForLeader(t, s1.RPC, s1.config.Datacenter)
+	if leader.IsLeader() {
+		t.Fatalf("expected %v to no longer be leader after Stepdown", leader)
+	}
+}
+
+// TestSQL_Query_ConsistencyLevels exercises all three read consistency
+// levels - and the unset zero value, which must behave like Strong rather
+// than silently falling back to None - against both the leader and a
+// follower of a 2-node cluster. Weak and Strong must succeed on the
+// follower by being forwarded to the leader; None must succeed on the
+// follower by being served locally.
+func TestSQL_Query_ConsistencyLevels(t *testing.T) {
+	t.Parallel()
+	dir1, s1 := testServer(t)
+	defer os.RemoveAll(dir1)
+	defer s1.Shutdown()
+
+	dir2, s2 := testServerDC(t, s1.config.Datacenter)
+	defer os.RemoveAll(dir2)
+	defer s2.Shutdown()
+
+	joinLAN(t, s2, s1)
+	testrpc.WaitForLeader(t, s1.RPC, s1.config.Datacenter)
+
+	leader, follower := s1, s2
+	if s2.IsLeader() {
+		leader, follower = s2, s1
+	}
+
+	leaderCodec := rpcClient(t, leader)
+	defer leaderCodec.Close()
+
+	execArgs := &structs.SQLExecuteRequest{
+		Statements: []*sqlite.Statement{{SQL: "CREATE TABLE foo (id INTEGER)"}},
+	}
+	var execReply structs.SQLExecuteResponse
+	if err := msgpackrpc.CallWithCodec(leaderCodec, "SQL.Execute", execArgs, &execReply); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	testrpc.WaitForLeader(t, follower.RPC, follower.config.Datacenter)
+
+	for _, node := range []struct {
+		name   string
+		server *Server
+	}{
+		{"leader", leader},
+		{"follower", follower},
+	} {
+		for _, tc := range []struct {
+			name string
+			lvl  structs.ConsistencyLevel
+		}{
+			{"zero value defaults to Strong", 0},
+			{"None", structs.None},
+			{"Weak", structs.Weak},
+			{"Strong", structs.Strong},
+		} {
+			t.Run(node.name+"/"+tc.name, func(t *testing.T) {
+				codec := rpcClient(t, node.server)
+				defer codec.Close()
+
+				args := &structs.SQLQueryRequest{
+					Statements: []*sqlite.Statement{{SQL: "SELECT * FROM foo"}},
+					Lvl:        tc.lvl,
+				}
+				var reply structs.SQLQueryResponse
+				if err := msgpackrpc.CallWithCodec(codec, "SQL.Query", args, &reply); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				if reply.Err != nil {
+					t.Fatalf("err: %v", reply.Err)
+				}
+			})
+		}
+	}
+
+	if structs.ConsistencyLevel(0) != structs.Strong {
+		t.Fatalf("zero value of ConsistencyLevel must be Strong, got %v", structs.ConsistencyLevel(0))
+	}
+}
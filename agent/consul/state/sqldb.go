@@ -1,28 +1,70 @@
 package state
 
 import (
-	"bytes"
+	"compress/gzip"
 	"errors"
 	"expvar"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/consul/agent/structs"
 	"github.com/hashicorp/consul/agent/consul/state/sqlite"
+	"github.com/hashicorp/raft"
 )
 
 var (
 	// ErrStoreInvalidState is returned when a Store is in an invalid
 	// state for the requested operation.
 	ErrStoreInvalidState = errors.New("store not in valid state")
+
+	// ErrStaleRead is returned by a None-consistency Query when the node
+	// hasn't heard from the leader within SQLQueryRequest.FreshnessMaxStale.
+	ErrStaleRead = errors.New("last contact with leader exceeds freshness max-stale")
+
+	// ErrInvalidBackupFormat is returned when Backup is called with a
+	// BackupFormat it doesn't recognize.
+	ErrInvalidBackupFormat = errors.New("invalid backup format")
+
+	// ErrConnectionTimeout is returned by Query when no pooled read
+	// connection becomes free within connectionTimeout.
+	ErrConnectionTimeout = errors.New("timed out waiting for a free database connection")
+)
+
+// BackupFormat represents the possible formats Backup can produce.
+type BackupFormat int
+
+const (
+	// BackupBinary streams the raw SQLite file.
+	BackupBinary BackupFormat = iota
+
+	// BackupBinaryGzip streams the raw SQLite file, gzip-compressed.
+	BackupBinaryGzip
+
+	// BackupSQL streams a text dump of the database, as a series of SQL
+	// statements that can be replayed into any SQLite instance.
+	BackupSQL
 )
 
 const (
-	sqliteFile           = "db.sqlite"
+	sqliteFile = "db.sqlite"
+
+	// connectionPoolCount is the number of read-only connections kept
+	// open against the database, in addition to the dedicated writer
+	// connection. SQLite allows many concurrent readers but only one
+	// writer, so writes never contend with this pool.
+	connectionPoolCount = 5
+
+	// connectionTimeout bounds how long Query waits for a free pooled
+	// connection before giving up.
+	connectionTimeout = 10 * time.Second
 )
 
 const (
@@ -30,8 +72,34 @@ const (
 	numSnaphotsBlocked = "num_snapshots_blocked"
 	numBackups         = "num_backups"
 	numRestores        = "num_restores"
+	connsFree          = "db_connections_free"
+	connsInUse         = "db_connections_in_use"
+	bytesRestored      = "bytes_restored"
+	restoreDurationMs  = "restore_duration_ms"
+
+	// restoreChunkSize is the buffer size used to stream a snapshot onto
+	// disk during Restore, so multi-GB databases don't need to be held in
+	// memory all at once.
+	restoreChunkSize = 32 * 1024
+
+	// indexSuffix names the sidecar file, next to the SQLite file, that
+	// persists dbAppliedIndex across restarts.
+	indexSuffix = ".index"
 )
 
+func init() {
+	stats = expvar.NewMap("consul_sqldb")
+}
+
+// RaftInfo is the subset of *raft.Raft that SQLDB needs in order to serve
+// None-consistency reads locally. It is an interface, rather than a
+// *raft.Raft field, so that this package doesn't need to depend on how the
+// consul package wires up its Server.
+type RaftInfo interface {
+	State() raft.RaftState
+	LastContact() time.Time
+}
+
 // SQLDB is a SQLite database, where all changes are made via Raft consensus.
 type SQLDB struct {
 	dbPath string    // Path to underlying SQLite file, if not in-memory.
@@ -39,27 +107,134 @@ type SQLDB struct {
 	memory bool   // Whether the database is in-memory only.
 
 	db      *sqlite.DB                // The underlying SQLite database.
-	dbConn  *sqlite.Conn              // Hidden connection to underlying SQLite database.
+	dbConn  *sqlite.Conn              // Dedicated writer connection, used by Execute.
+
+	readPool chan *sqlite.Conn // Bounded pool of read-only connections, used by Query.
 
 	closedMu sync.Mutex
 	closed   bool // Has the store been closed?
 
 	restoreMu sync.RWMutex // Restore needs exclusive access to database.
 
+	raft RaftInfo // Used to bound staleness of None-consistency reads.
+
+	indexMu           sync.Mutex
+	dbAppliedIndex    uint64 // Raft index of the last log entry that mutated the database.
+	lastSnapshotIndex uint64 // dbAppliedIndex as of the last snapshot taken.
+	fullNeeded        bool   // Forces FullNeeded() to true until the next snapshot.
+
 	logger *log.Logger
 }
 
+// SetRaft wires up the raft instance used to bound the staleness of
+// None-consistency reads. It's optional; until it is called, FreshnessMaxStale
+// is not enforced.
+func (s *SQLDB) SetRaft(r RaftInfo) {
+	s.raft = r
+}
+
+// indexPath returns the path of the sidecar file used to persist
+// dbAppliedIndex across restarts. It is empty for in-memory databases,
+// which have no applied-index persistence.
+func (s *SQLDB) indexPath() string {
+	if s.memory {
+		return ""
+	}
+	return s.dbPath + indexSuffix
+}
+
+// loadAppliedIndex reads dbAppliedIndex back from its sidecar file, if one
+// exists. A missing file means index 0, which is the correct value for a
+// brand new database.
+func (s *SQLDB) loadAppliedIndex() error {
+	path := s.indexPath()
+	if path == "" {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	idx, err := strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return err
+	}
+	s.dbAppliedIndex = idx
+	return nil
+}
+
+// SetAppliedIndex records the Raft index of the last log entry applied to
+// the database, persisting it next to the SQLite file so it survives a
+// restart.
+func (s *SQLDB) SetAppliedIndex(idx uint64) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.dbAppliedIndex = idx
+
+	path := s.indexPath()
+	if path == "" {
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(strconv.FormatUint(idx, 10)), 0600)
+}
+
+// AppliedIndex returns the Raft index of the last log entry applied to the
+// database.
+func (s *SQLDB) AppliedIndex() uint64 {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	return s.dbAppliedIndex
+}
+
+// FullNeeded reports whether a full snapshot of the database must be sent,
+// as opposed to relying on incremental log replay. It returns true after a
+// restart or a call to SetRestorePath, and again whenever the database has
+// been modified since the last snapshot was taken.
+func (s *SQLDB) FullNeeded() bool {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	return s.fullNeeded || s.dbAppliedIndex != s.lastSnapshotIndex
+}
+
+// MarkSnapshotTaken records that a full snapshot was just produced, so
+// FullNeeded returns false until the database is next modified.
+func (s *SQLDB) MarkSnapshotTaken() {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.lastSnapshotIndex = s.dbAppliedIndex
+	s.fullNeeded = false
+}
+
+// SetRestorePath marks the database as needing a full snapshot, such as
+// when an operator has pointed the store at an on-disk snapshot to load on
+// the next Open, bypassing the usual log-replay path. path itself is not
+// recorded, and Open does not load anything from it.
+func (s *SQLDB) SetRestorePath(path string) error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	s.fullNeeded = true
+	return nil
+}
+
 // stats captures stats for the Store.
 var stats *expvar.Map
 
-// NewStore returns a new Store.
-func NewSQLDB(dir string, dsn string, memory bool, logger *log.Logger) (*SQLDB, error) {
+// NewStore returns a new Store. raft is used to bound the staleness of
+// None-consistency reads; it may be nil, in which case FreshnessMaxStale is
+// never enforced.
+func NewSQLDB(dir string, dsn string, memory bool, raft RaftInfo, logger *log.Logger) (*SQLDB, error) {
 	if logger == nil {
 		logger = log.New(os.Stderr, "[store] ", log.LstdFlags)
 	}
 
 	sqldb := &SQLDB{
 		dbPath:         filepath.Join(dir, sqliteFile),
+		raft:           raft,
 		logger:         logger,
 	}
 	err := sqldb.Open()
@@ -100,16 +275,81 @@ func (s *SQLDB) Open() error {
 	}
 	s.db = db
 
-	// Get utility connection to database.
+	// Get dedicated writer connection to database.
 	conn, err := s.db.Connect()
 	if err != nil {
 		return err
 	}
 	s.dbConn = conn
 
+	if err := s.openReadPool(); err != nil {
+		return err
+	}
+
+	if err := s.loadAppliedIndex(); err != nil {
+		return err
+	}
+	// A freshly opened database has no in-memory record of whether its
+	// contents match the last snapshot raft took, so force one.
+	s.indexMu.Lock()
+	s.fullNeeded = true
+	s.indexMu.Unlock()
+
+	return nil
+}
+
+// openReadPool opens connectionPoolCount read-only connections against the
+// database and stages them for Query to draw from.
+func (s *SQLDB) openReadPool() error {
+	pool := make(chan *sqlite.Conn, connectionPoolCount)
+	for i := 0; i < connectionPoolCount; i++ {
+		conn, err := s.db.Connect()
+		if err != nil {
+			return err
+		}
+		pool <- conn
+	}
+	s.readPool = pool
+	s.publishStats()
 	return nil
 }
 
+// publishStats exposes live read-pool utilization via expvar.
+func (s *SQLDB) publishStats() {
+	stats.Set(connsFree, expvar.Func(func() interface{} {
+		return len(s.readPool)
+	}))
+	stats.Set(connsInUse, expvar.Func(func() interface{} {
+		return connectionPoolCount - len(s.readPool)
+	}))
+}
+
+// closeReadPool drains and closes every connection in the read pool. It
+// blocks until all connectionPoolCount connections have been returned, so
+// callers must not have any Query calls in flight.
+func (s *SQLDB) closeReadPool() error {
+	for i := 0; i < connectionPoolCount; i++ {
+		conn := <-s.readPool
+		if err := conn.Close(); err != nil {
+			return err
+		}
+	}
+	close(s.readPool)
+	s.readPool = nil
+	return nil
+}
+
+// Stats returns the current read-pool utilization, for publishing via
+// expvar.
+func (s *SQLDB) Stats() map[string]interface{} {
+	free := len(s.readPool)
+	return map[string]interface{}{
+		"pool_size":        connectionPoolCount,
+		"free_connections": free,
+		"in_use":           connectionPoolCount - free,
+	}
+}
+
 // Close closes the store. If wait is true, waits for a graceful shutdown.
 // Once closed, a Store may not be re-opened.
 func (s *SQLDB) Close(wait bool) error {
@@ -122,6 +362,17 @@ func (s *SQLDB) Close(wait bool) error {
 		s.closed = true
 	}()
 
+	// Hold restoreMu for the same reason Restore does: draining
+	// s.readPool here must not race a Query that's blocked on
+	// <-s.readPool, or closeReadPool closing the channel mid-flight would
+	// hand that Query a nil *sqlite.Conn instead of blocking it.
+	s.restoreMu.Lock()
+	defer s.restoreMu.Unlock()
+
+	if err := s.closeReadPool(); err != nil {
+		return err
+	}
+
 	if err := s.dbConn.Close(); err != nil {
 		return err
 	}
@@ -131,29 +382,79 @@ func (s *SQLDB) Close(wait bool) error {
 	return nil
 }
 
-// Execute applies a Raft log entry to the database.
-func (s *SQLDB) Execute(queries []string, atomic bool) interface{} {
+// Execute applies a Raft log entry to the database. Parameters on each
+// statement are bound on the connection, rather than interpolated into the
+// SQL text. index is the Raft index of the log entry being applied; it is
+// recorded via SetAppliedIndex regardless of whether the statements
+// themselves succeed, since the log entry has been applied either way, so
+// that FullNeeded reports true again after this write.
+func (s *SQLDB) Execute(stmts []*sqlite.Statement, atomic bool, index uint64) interface{} {
 	s.restoreMu.RLock()
 	defer s.restoreMu.RUnlock()
 
-	r, err := s.dbConn.Execute(queries, atomic, true)
+	r, err := s.dbConn.Execute(stmts, atomic, true)
+	if serr := s.SetAppliedIndex(index); serr != nil {
+		s.logger.Printf("[ERR] sqldb: failed to persist applied index %d: %v", index, serr)
+	}
 	return &structs.SQLExecuteResponse{Results: r, Err: err}
 }
 
-// Query applies a Raft log entry to the database.
-func (s *SQLDB) Query(queries []string, atomic bool) interface{} {
+// Query executes a read-only query. maxStale, when non-zero, bounds how
+// long ago this node may have last heard from the leader before the read is
+// rejected with ErrStaleRead; pass zero to skip the check (appropriate for
+// Weak and Strong reads, which are already known to be fresh).
+func (s *SQLDB) Query(stmts []*sqlite.Statement, atomic bool, maxStale time.Duration) interface{} {
 	s.restoreMu.RLock()
 	defer s.restoreMu.RUnlock()
 
-	r, err := s.dbConn.Query(queries, atomic, true)
+	if maxStale > 0 && s.raft != nil {
+		if stale := time.Since(s.raft.LastContact()); stale > maxStale {
+			return &structs.SQLQueryResponse{Err: ErrStaleRead}
+		}
+	}
+
+	var conn *sqlite.Conn
+	select {
+	case conn = <-s.readPool:
+	case <-time.After(connectionTimeout):
+		return &structs.SQLQueryResponse{Err: ErrConnectionTimeout}
+	}
+	defer func() { s.readPool <- conn }()
+
+	r, err := conn.Query(stmts, atomic, true)
 	return &structs.SQLQueryResponse{Rows: r, Err: err}
 }
 
-// Restore restores the node to a previous state.
-func (s *SQLDB) Restore(src []byte) error {
+// Restore restores the node to a previous state, streaming src onto disk in
+// fixed-size chunks rather than buffering the whole snapshot in memory, so
+// it can handle multi-GB databases. Progress is published incrementally via
+// expvar so it can be observed while the restore is in flight. index is the
+// Raft index the snapshot was taken at, and is recorded via
+// SetAppliedIndex so AppliedIndex reflects the restored data immediately,
+// rather than the pre-restore value until the next write.
+func (s *SQLDB) Restore(src io.Reader, index uint64) (retErr error) {
 	s.restoreMu.Lock()
 	defer s.restoreMu.Unlock()
 
+	start := time.Now()
+
+	// The read pool's connections were opened against the old file
+	// contents; they must be closed and reopened once the load below
+	// completes, or reads could keep seeing stale data.
+	if err := s.closeReadPool(); err != nil {
+		return err
+	}
+	// The pool must come back on every exit path, not just success: until
+	// s.dbConn.Load below replaces its contents, s.db is untouched, so
+	// it's always safe to reopen against it. Otherwise a failed restore
+	// (bad stream, corrupt snapshot) would leave s.readPool nil and every
+	// subsequent Query blocking for connectionTimeout before failing.
+	defer func() {
+		if err := s.openReadPool(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
 	f, err := ioutil.TempFile("", "rqlilte-snap-")
 	if err != nil {
 		return err
@@ -161,8 +462,21 @@ func (s *SQLDB) Restore(src []byte) error {
 	defer os.Remove(f.Name())
 	defer f.Close()
 
-	if _, err := f.Write(src); err != nil {
-		return err
+	buf := make([]byte, restoreChunkSize)
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if _, werr := f.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			stats.Add(bytesRestored, int64(n))
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
 	}
 
 	// Create new database from file, connect, and load
@@ -180,12 +494,51 @@ func (s *SQLDB) Restore(src []byte) error {
 		return err
 	}
 
+	if err := s.SetAppliedIndex(index); err != nil {
+		return err
+	}
+
+	// The database was just replaced wholesale, so the next FSM snapshot
+	// must be a full one regardless of what dbAppliedIndex says.
+	s.indexMu.Lock()
+	s.fullNeeded = true
+	s.indexMu.Unlock()
+
 	stats.Add(numRestores, 1)
+	stats.Set(restoreDurationMs, newExpvarInt(time.Since(start)/time.Millisecond))
 	return nil
 }
 
-// Database copies contents of the underlying SQLite file to dst
-func (s *SQLDB) Backup(dst *bytes.Buffer) error {
+// newExpvarInt wraps an integer duration count in an *expvar.Int, for
+// publishing a point-in-time gauge via stats.Set.
+func newExpvarInt(v time.Duration) *expvar.Int {
+	i := new(expvar.Int)
+	i.Set(int64(v))
+	return i
+}
+
+// Backup writes the contents of the underlying SQLite database to dst, in
+// the requested format.
+func (s *SQLDB) Backup(dst io.Writer, format BackupFormat) error {
+	switch format {
+	case BackupBinary:
+		return s.backupBinary(dst)
+	case BackupBinaryGzip:
+		gw := gzip.NewWriter(dst)
+		if err := s.backupBinary(gw); err != nil {
+			gw.Close()
+			return err
+		}
+		return gw.Close()
+	case BackupSQL:
+		return s.backupSQL(dst)
+	default:
+		return ErrInvalidBackupFormat
+	}
+}
+
+// backupBinary copies the raw SQLite file to dst.
+func (s *SQLDB) backupBinary(dst io.Writer) error {
 	f, err := ioutil.TempFile("", "rqlilte-snap-")
 	if err != nil {
 		return err
@@ -221,6 +574,111 @@ func (s *SQLDB) Backup(dst *bytes.Buffer) error {
 	return err
 }
 
+// backupSQL writes a text dump of the database to dst: CREATE TABLE/INDEX
+// statements from sqlite_master, followed by an INSERT for every row of
+// every table, so the result can be replayed into any SQLite instance. The
+// whole dump runs inside one real SQLite transaction on the writer
+// connection, with restoreMu held exclusively, so Execute and Query calls
+// wait until it completes and the dump is a consistent snapshot.
+func (s *SQLDB) backupSQL(dst io.Writer) (err error) {
+	// Execute shares s.dbConn and would otherwise run inside this
+	// transaction.
+	s.restoreMu.Lock()
+	defer s.restoreMu.Unlock()
+
+	if err := s.dbConn.Begin(); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			s.dbConn.Rollback()
+			return
+		}
+		err = s.dbConn.Commit()
+	}()
+
+	if _, err := fmt.Fprintln(dst, "BEGIN TRANSACTION;"); err != nil {
+		return err
+	}
+
+	tables, err := s.dbConn.Query(stmtsFor(
+		"SELECT name, sql FROM sqlite_master WHERE type='table' AND sql NOT NULL",
+	), false, false)
+	if err != nil {
+		return err
+	}
+	for _, row := range tables[0].Values {
+		name, _ := row[0].(string)
+		schema, _ := row[1].(string)
+		if _, err := fmt.Fprintf(dst, "%s;\n", schema); err != nil {
+			return err
+		}
+
+		data, err := s.dbConn.Query(stmtsFor(
+			fmt.Sprintf(`SELECT * FROM "%s"`, name),
+		), false, false)
+		if err != nil {
+			return err
+		}
+		for _, values := range data[0].Values {
+			quoted := make([]string, len(values))
+			for i, v := range values {
+				quoted[i] = quoteSQLValue(v)
+			}
+			if _, err := fmt.Fprintf(dst, "INSERT INTO \"%s\" VALUES(%s);\n",
+				name, strings.Join(quoted, ",")); err != nil {
+				return err
+			}
+		}
+	}
+
+	indexes, err := s.dbConn.Query(stmtsFor(
+		"SELECT sql FROM sqlite_master WHERE type='index' AND sql NOT NULL",
+	), false, false)
+	if err != nil {
+		return err
+	}
+	for _, row := range indexes[0].Values {
+		sql, _ := row[0].(string)
+		if _, err := fmt.Fprintf(dst, "%s;\n", sql); err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintln(dst, "COMMIT;")
+	return err
+}
+
+// stmtsFor wraps plain SQL text in unparameterized statements, for the
+// handful of internal introspection queries the backup/dump code issues
+// itself.
+func stmtsFor(queries ...string) []*sqlite.Statement {
+	stmts := make([]*sqlite.Statement, len(queries))
+	for i, q := range queries {
+		stmts[i] = &sqlite.Statement{SQL: q}
+	}
+	return stmts
+}
+
+// quoteSQLValue renders v as a SQL literal suitable for an INSERT statement.
+func quoteSQLValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.Replace(x, "'", "''", -1) + "'"
+	case []byte:
+		return fmt.Sprintf("X'%x'", x)
+	case bool:
+		if x {
+			return "1"
+		}
+		return "0"
+	default:
+		return fmt.Sprintf("%v", x)
+	}
+}
+
 func (s *Snapshot) SQLDB() *SQLDB {
 	return s.store.sqldb
 }
@@ -229,10 +687,14 @@ func (r *Restore) SQLDB() *SQLDB {
 	return r.store.sqldb
 }
 
-func (s *Store) Execute(queries []string, atomic bool) interface{} {
-	return s.sqldb.Execute(queries, atomic)
+func (s *Store) Execute(stmts []*sqlite.Statement, atomic bool, index uint64) interface{} {
+	return s.sqldb.Execute(stmts, atomic, index)
+}
+
+func (s *Store) Query(stmts []*sqlite.Statement, atomic bool, maxStale time.Duration) interface{} {
+	return s.sqldb.Query(stmts, atomic, maxStale)
 }
 
-func (s *Store) Query(queries []string, atomic bool) interface{} {
-	return s.sqldb.Query(queries, atomic)
+func (s *Store) Backup(dst io.Writer, format BackupFormat) error {
+	return s.sqldb.Backup(dst, format)
 }
@@ -0,0 +1,295 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Statement is a single SQL statement paired with its bind parameters.
+// Parameters are bound on the prepared statement with sqlite3_bind_*,
+// never interpolated into SQL, so leave Parameters nil to run SQL as a
+// plain, unparameterized statement.
+type Statement struct {
+	SQL        string
+	Parameters []interface{}
+}
+
+// Result is the outcome of executing one Statement.
+type Result struct {
+	LastInsertID int64
+	RowsAffected int64
+	Time         float64
+	Err          string `json:",omitempty"`
+}
+
+// Rows is the outcome of querying one Statement.
+type Rows struct {
+	Columns []string
+	Types   []string
+	Values  [][]interface{}
+	Time    float64
+	Err     string `json:",omitempty"`
+}
+
+// Conn is a single connection to a SQLite database, with its own cache of
+// prepared statements.
+type Conn struct {
+	db    *sql.DB
+	stmts *stmtCache
+
+	// tx, if set, is an explicit transaction started by Begin. Execute and
+	// Query run inside it regardless of their own atomic argument, so a
+	// caller that needs several Query/Execute calls to see one consistent
+	// snapshot can span them with Begin/Commit.
+	tx *sql.Tx
+}
+
+// Begin starts an explicit transaction on the connection. Every Execute and
+// Query call made before the matching Commit or Rollback runs inside it,
+// so callers that need a multi-statement consistent snapshot - rather than
+// just one atomic Execute/Query call - can get one.
+func (c *Conn) Begin() error {
+	if c.tx != nil {
+		return errors.New("transaction already in progress")
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	c.tx = tx
+	return nil
+}
+
+// Commit commits the transaction started by Begin.
+func (c *Conn) Commit() error {
+	if c.tx == nil {
+		return errors.New("no transaction in progress")
+	}
+	tx := c.tx
+	c.tx = nil
+	return tx.Commit()
+}
+
+// Rollback rolls back the transaction started by Begin. It is a no-op if
+// no transaction is in progress, so it is safe to defer unconditionally
+// right after a successful Begin.
+func (c *Conn) Rollback() error {
+	if c.tx == nil {
+		return nil
+	}
+	tx := c.tx
+	c.tx = nil
+	return tx.Rollback()
+}
+
+// prepare returns a cached *sql.Stmt for sql, preparing and caching one on
+// a miss.
+func (c *Conn) prepare(sql string) (*sql.Stmt, error) {
+	if stmt, ok := c.stmts.get(sql); ok {
+		return stmt, nil
+	}
+	stmt, err := c.db.Prepare(sql)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts.add(sql, stmt)
+	return stmt, nil
+}
+
+// beginTx returns the transaction Execute/Query should run their
+// statements in: the explicit one started by Begin if there is one,
+// otherwise a new one if atomic is requested, otherwise none. owned
+// reports whether the caller is responsible for committing/rolling back
+// the returned tx - it's false when reusing an explicit Begin, since that
+// transaction's lifetime belongs to whoever called Begin.
+func (c *Conn) beginTx(atomic bool) (tx *sql.Tx, owned bool, err error) {
+	if c.tx != nil {
+		return c.tx, false, nil
+	}
+	if !atomic {
+		return nil, false, nil
+	}
+	tx, err = c.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	return tx, true, nil
+}
+
+// Execute runs stmts against the database. Each statement's Parameters are
+// bound by the driver on a cached prepared statement rather than
+// interpolated into the SQL text. If atomic, every statement runs in a
+// single transaction that is rolled back on the first error.
+func (c *Conn) Execute(stmts []*Statement, atomic bool, timings bool) ([]*Result, error) {
+	tx, owned, err := c.beginTx(atomic)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*Result, len(stmts))
+	for i, s := range stmts {
+		start := time.Now()
+
+		stmt, err := c.prepare(s.SQL)
+		if err != nil {
+			if owned {
+				tx.Rollback()
+			}
+			return nil, err
+		}
+		if tx != nil {
+			stmt = tx.Stmt(stmt)
+		}
+
+		result := &Result{}
+		r, err := stmt.Exec(s.Parameters...)
+		if timings {
+			result.Time = time.Since(start).Seconds()
+		}
+		if err != nil {
+			result.Err = err.Error()
+			results[i] = result
+			if owned {
+				tx.Rollback()
+				return results, err
+			}
+			continue
+		}
+
+		result.LastInsertID, _ = r.LastInsertId()
+		result.RowsAffected, _ = r.RowsAffected()
+		results[i] = result
+	}
+
+	if owned {
+		if err := tx.Commit(); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// Query runs stmts as read-only queries against the database. Each
+// statement's Parameters are bound by the driver on a cached prepared
+// statement rather than interpolated into the SQL text. If atomic, every
+// statement runs inside a single read transaction, so they all see the
+// same snapshot of the database.
+func (c *Conn) Query(stmts []*Statement, atomic bool, timings bool) ([]*Rows, error) {
+	tx, owned, err := c.beginTx(atomic)
+	if err != nil {
+		return nil, err
+	}
+	if owned {
+		defer tx.Rollback()
+	}
+
+	results := make([]*Rows, len(stmts))
+	for i, s := range stmts {
+		start := time.Now()
+
+		stmt, err := c.prepare(s.SQL)
+		if err != nil {
+			return nil, err
+		}
+		if tx != nil {
+			stmt = tx.Stmt(stmt)
+		}
+
+		rows, err := queryRows(stmt, s.Parameters)
+		if timings {
+			rows.Time = time.Since(start).Seconds()
+		}
+		if err != nil {
+			rows.Err = err.Error()
+		}
+		results[i] = rows
+	}
+	return results, nil
+}
+
+// queryRows runs stmt with params bound and buffers the result set, since
+// *sql.Rows can't outlive the prepared statement it was read from once the
+// statement is returned to the cache for reuse.
+func queryRows(stmt *sql.Stmt, params []interface{}) (*Rows, error) {
+	rows, err := stmt.Query(params...)
+	if err != nil {
+		return &Rows{}, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return &Rows{}, err
+	}
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return &Rows{}, err
+	}
+	types := make([]string, len(colTypes))
+	for i, t := range colTypes {
+		types[i] = t.DatabaseTypeName()
+	}
+
+	result := &Rows{Columns: columns, Types: types}
+	dest := make([]interface{}, len(columns))
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		for i := range dest {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return result, err
+		}
+		result.Values = append(result.Values, values)
+	}
+	return result, rows.Err()
+}
+
+// withRaw runs fn against the *sqlite3.SQLiteConn backing c, for the
+// handful of operations (Backup, Load) that need the driver connection
+// directly rather than going through database/sql.
+func (c *Conn) withRaw(fn func(*sqlite3.SQLiteConn) error) error {
+	conn, err := c.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn interface{}) error {
+		return fn(driverConn.(*sqlite3.SQLiteConn))
+	})
+}
+
+// Backup copies the entire contents of this connection's database into
+// dst, using SQLite's online backup API.
+func (c *Conn) Backup(dst *Conn) error {
+	return c.withRaw(func(srcConn *sqlite3.SQLiteConn) error {
+		return dst.withRaw(func(dstConn *sqlite3.SQLiteConn) error {
+			bk, err := dstConn.Backup("main", srcConn, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := bk.Step(-1); err != nil {
+				bk.Close()
+				return err
+			}
+			return bk.Close()
+		})
+	})
+}
+
+// Load replaces the entire contents of this connection's database with
+// src's, using SQLite's online backup API run in the opposite direction
+// from Backup.
+func (c *Conn) Load(src *Conn) error {
+	return src.Backup(c)
+}
+
+// Close closes the connection and every prepared statement cached on it.
+func (c *Conn) Close() error {
+	c.stmts.close()
+	return c.db.Close()
+}
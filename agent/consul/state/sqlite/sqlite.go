@@ -0,0 +1,53 @@
+// Package sqlite wraps access to a single SQLite database. Statement text
+// and bind values are kept separate all the way down to the driver: values
+// are bound with sqlite3_bind_* on a prepared statement, never interpolated
+// into the SQL text, and prepared statements are cached per-connection so
+// repeat statements don't pay the prepare cost twice.
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DB represents a SQLite database, identified by the DSN used to open
+// connections against it.
+type DB struct {
+	dsn string
+}
+
+// NewDB returns a DB for the SQLite file at path, using dsn as additional
+// driver connection parameters. If memory is true, path merely names an
+// in-memory database shared by every Conn opened against this DB.
+func NewDB(path string, dsn string, memory bool) (*DB, error) {
+	source := fmt.Sprintf("file:%s", path)
+	sep := "?"
+	if memory {
+		source = fmt.Sprintf("file:%s?mode=memory&cache=shared", path)
+		sep = "&"
+	}
+	if dsn != "" {
+		source = source + sep + dsn
+	}
+	return &DB{dsn: source}, nil
+}
+
+// Connect opens a new connection against the database, with its own
+// prepared-statement cache.
+func (db *DB) Connect() (*Conn, error) {
+	sqlDB, err := sql.Open("sqlite3", db.dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer at a time; a single underlying
+	// connection per Conn keeps prepared statements (and the cache that
+	// tracks them) tied to one connection's lifetime.
+	sqlDB.SetMaxOpenConns(1)
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return &Conn{db: sqlDB, stmts: newStmtCache(stmtCacheSize)}, nil
+}
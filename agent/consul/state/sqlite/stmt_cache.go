@@ -0,0 +1,49 @@
+package sqlite
+
+import (
+	"database/sql"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// stmtCacheSize bounds how many prepared statements a Conn keeps warm.
+// Once full, the least recently used one is closed to make room for the
+// next miss.
+const stmtCacheSize = 128
+
+// stmtCache is an LRU cache of prepared statements, keyed by SQL text.
+// Evicted statements are closed so they don't leak server-side resources.
+type stmtCache struct {
+	lru *lru.Cache
+}
+
+func newStmtCache(size int) *stmtCache {
+	c, err := lru.NewWithEvict(size, func(_ interface{}, value interface{}) {
+		value.(*sql.Stmt).Close()
+	})
+	if err != nil {
+		// Only returns an error for a non-positive size, which
+		// stmtCacheSize never is.
+		panic(err)
+	}
+	return &stmtCache{lru: c}
+}
+
+func (c *stmtCache) get(sql string) (*sql.Stmt, bool) {
+	v, ok := c.lru.Get(sql)
+	if !ok {
+		return nil, false
+	}
+	return v.(*sql.Stmt), true
+}
+
+func (c *stmtCache) add(sql string, stmt *sql.Stmt) {
+	c.lru.Add(sql, stmt)
+}
+
+// close closes every statement still held by the cache.
+func (c *stmtCache) close() {
+	for _, key := range c.lru.Keys() {
+		c.lru.Remove(key)
+	}
+}
@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"net/http"
+
+	"github.com/hashicorp/consul/agent/consul/state"
+)
+
+// SQLBackup streams a backup of the SQL database. The format is selected
+// via the "fmt" query parameter: "binary" (the default) for the raw SQLite
+// file, "gzip" for a gzip-compressed copy of the same, or "sql" for a text
+// dump of SQL statements that can be replayed into any SQLite instance.
+func (s *HTTPServer) SQLBackup(resp http.ResponseWriter, req *http.Request) (interface{}, error) {
+	format := state.BackupBinary
+	switch req.URL.Query().Get("fmt") {
+	case "", "binary":
+		format = state.BackupBinary
+	case "gzip":
+		format = state.BackupBinaryGzip
+	case "sql":
+		format = state.BackupSQL
+	default:
+		return nil, state.ErrInvalidBackupFormat
+	}
+
+	if err := s.agent.server.fsm.State().Backup(resp, format); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -1,20 +1,44 @@
 package structs
 
-import "github.com/hashicorp/consul/agent/consul/state/sqlite"
+import (
+	"time"
+
+	"github.com/hashicorp/consul/agent/consul/state/sqlite"
+)
 
 // QueryRequest represents a query that returns rows, and does not modify
 // the database.
 type SQLQueryRequest struct {
+	// Statements are the parameterized statements to run. Values are bound
+	// with sqlite3_bind_*, rather than interpolated into the SQL text.
+	Statements []*sqlite.Statement
+
+	// Queries is a deprecated alternative to Statements, kept for one
+	// release so existing callers keep working: each entry is run as an
+	// unparameterized statement. If both are set, Statements is used.
 	Queries []string
+
 	Timings bool
 	Atomic  bool
 	Lvl     ConsistencyLevel
 
+	// FreshnessMaxStale bounds how far behind the leader a None-level read
+	// may be before it is rejected with ErrStaleRead. It is measured
+	// against the server's raft.LastContact() time, and is ignored for the
+	// Weak and Strong consistency levels. Zero means no bound is enforced.
+	FreshnessMaxStale time.Duration
+
 	// WriteRequest is a common struct containing ACL tokens and other
 	// write-related common elements for requests.
 	WriteRequest
 }
 
+// GetStatements returns the statements to run: Statements if set, otherwise
+// the deprecated Queries converted to unparameterized statements.
+func (r *SQLQueryRequest) GetStatements() []*sqlite.Statement {
+	return getStatements(r.Statements, r.Queries)
+}
+
 // QueryResponse encapsulates a response to a query.
 type SQLQueryResponse struct {
 	Rows []*sqlite.Rows
@@ -25,7 +49,15 @@ type SQLQueryResponse struct {
 // ExecuteRequest represents a query that returns now rows, but does modify
 // the database.
 type SQLExecuteRequest struct {
+	// Statements are the parameterized statements to run. Values are bound
+	// with sqlite3_bind_*, rather than interpolated into the SQL text.
+	Statements []*sqlite.Statement
+
+	// Queries is a deprecated alternative to Statements, kept for one
+	// release so existing callers keep working: each entry is run as an
+	// unparameterized statement. If both are set, Statements is used.
 	Queries []string
+
 	Timings bool
 	Atomic  bool
 
@@ -34,6 +66,25 @@ type SQLExecuteRequest struct {
 	WriteRequest
 }
 
+// GetStatements returns the statements to run: Statements if set, otherwise
+// the deprecated Queries converted to unparameterized statements.
+func (r *SQLExecuteRequest) GetStatements() []*sqlite.Statement {
+	return getStatements(r.Statements, r.Queries)
+}
+
+// getStatements implements the shared Statements-or-Queries fallback used by
+// both SQLQueryRequest.GetStatements and SQLExecuteRequest.GetStatements.
+func getStatements(statements []*sqlite.Statement, queries []string) []*sqlite.Statement {
+	if len(statements) > 0 {
+		return statements
+	}
+	stmts := make([]*sqlite.Statement, len(queries))
+	for i, q := range queries {
+		stmts[i] = &sqlite.Statement{SQL: q}
+	}
+	return stmts
+}
+
 // ExecuteResponse encapsulates a response to an execute.
 type SQLExecuteResponse struct {
 	Results []*sqlite.Result
@@ -44,9 +95,22 @@ type SQLExecuteResponse struct {
 // ConsistencyLevel represents the available read consistency levels.
 type ConsistencyLevel int
 
-// Represents the available consistency levels.
+// Represents the available consistency levels. Strong is the zero value so
+// that a request which doesn't set Lvl - which includes every caller that
+// predates tiered consistency - keeps the same linearized-read guarantee
+// SQL.Query always provided, rather than silently downgrading to the
+// weakest level.
 const (
-	None ConsistencyLevel = iota
+	// Strong goes through raftApply, so the read is linearized against
+	// all writes.
+	Strong ConsistencyLevel = iota
+
+	// Weak requires the read to be served by the current leader, but
+	// reads locally rather than going through raftApply.
 	Weak
-	Strong
+
+	// None serves the read from the local database on whichever node
+	// receives the request, without any Raft round-trip. It may return
+	// stale data, bounded by SQLQueryRequest.FreshnessMaxStale.
+	None
 )